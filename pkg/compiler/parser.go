@@ -6,6 +6,7 @@ import (
 	"github.com/golang/glog"
 
 	"github.com/marapongo/mu/pkg/ast"
+	"github.com/marapongo/mu/pkg/compiler/template"
 	"github.com/marapongo/mu/pkg/diag"
 	"github.com/marapongo/mu/pkg/encoding"
 	"github.com/marapongo/mu/pkg/errors"
@@ -17,14 +18,23 @@ type Parser interface {
 	// Parse detects and parses input from the given path.  If an error occurs, the return value will be nil.  It is
 	// expected that errors are conveyed using the diag.Sink interface.
 	Parse(doc *diag.Document) *ast.Stack
+
+	// ParseChild parses a nested/imported Mufile the same way Parse does, except that its template scope is a
+	// child of the parent stack's: vars are visible to the child's templates alongside (and, on conflict,
+	// overriding) everything visible to the parent.
+	ParseChild(doc *diag.Document, vars map[string]interface{}) *ast.Stack
 }
 
 func NewParser(c Compiler) Parser {
-	return &parser{c}
+	return &parser{
+		c:     c,
+		scope: template.NewScope(c.Workspace().Variables()),
+	}
 }
 
 type parser struct {
-	c Compiler
+	c     Compiler
+	scope *template.Scope // the root template variable scope, seeded from the workspace/env.
 }
 
 func (p *parser) Diag() diag.Sink {
@@ -32,6 +42,14 @@ func (p *parser) Diag() diag.Sink {
 }
 
 func (p *parser) Parse(doc *diag.Document) *ast.Stack {
+	return p.parse(doc, p.scope)
+}
+
+func (p *parser) ParseChild(doc *diag.Document, vars map[string]interface{}) *ast.Stack {
+	return p.parse(doc, p.scope.Push(vars))
+}
+
+func (p *parser) parse(doc *diag.Document, scope *template.Scope) *ast.Stack {
 	glog.Infof("Parsing Mufile: %v (len(body)=%v)", doc.File, len(doc.Body))
 	if glog.V(2) {
 		defer func() {
@@ -40,8 +58,17 @@ func (p *parser) Parse(doc *diag.Document) *ast.Stack {
 		}()
 	}
 
+	// Before we can deserialize the contents, run the body through any template engine claimed by its extension
+	// (e.g. "Mu.yaml.tmpl" is expanded by the Go text/template engine before being treated as YAML).  Variables
+	// are resolved from scope, which is the root scope (seeded from the workspace/environment) for a top-level
+	// Parse, or a fresh child scope layered on top of it for ParseChild, so nested Mufiles may see (and override)
+	// their parents' properties.
+	body, err := template.Expand(doc, doc.Body, scope, p.Diag())
+	if err != nil {
+		return nil
+	}
+
 	// We support many file formats.  Detect the file extension and deserialize the contents.
-	// TODO: we need to expand templates as part of the parsing process
 	var stack ast.Stack
 	marshaler, has := encoding.Marshalers[doc.Ext()]
 	if !has {
@@ -49,7 +76,7 @@ func (p *parser) Parse(doc *diag.Document) *ast.Stack {
 		return nil
 	}
 
-	if err := marshaler.Unmarshal(doc.Body, &stack); err != nil {
+	if err := marshaler.Unmarshal(body, &stack); err != nil {
 		p.Diag().Errorf(errors.IllegalMufileSyntax.WithDocument(doc), err)
 		// TODO: it would be great if we issued an error per issue found in the file with line/col numbers.
 		return nil
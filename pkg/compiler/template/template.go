@@ -0,0 +1,232 @@
+// Copyright 2016 Marapongo, Inc. All rights reserved.
+
+// Package template implements the pluggable template-expansion stage that runs over a Mufile's body before it is
+// handed off to the marshaler for unmarshaling into an ast.Stack.  Template engines are registered against a file
+// extension (e.g. ".tmpl") and are consulted, in order, before the "real" marshaler extension is resolved.
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/marapongo/mu/pkg/diag"
+	"github.com/marapongo/mu/pkg/errors"
+)
+
+// Scope supplies the variables that are visible to a template during expansion.  Scopes nest: a child stack's
+// scope sees its own properties plus anything inherited from its parents, with the child's bindings taking
+// precedence in the event of a name collision.
+type Scope struct {
+	Vars   map[string]interface{}
+	Parent *Scope
+}
+
+// NewScope creates a fresh, childless scope seeded with the given variables (typically workspace and environment
+// properties).
+func NewScope(vars map[string]interface{}) *Scope {
+	return &Scope{Vars: vars}
+}
+
+// Push creates a child scope layered on top of this one.  Lookups fall back to the parent when a variable isn't
+// found locally, so nested stacks may override a subset of their ancestors' properties.
+func (s *Scope) Push(vars map[string]interface{}) *Scope {
+	return &Scope{Vars: vars, Parent: s}
+}
+
+// Lookup resolves a variable by name, searching outward from this scope to its ancestors.
+func (s *Scope) Lookup(name string) (interface{}, bool) {
+	for sc := s; sc != nil; sc = sc.Parent {
+		if v, has := sc.Vars[name]; has {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// flatten collapses a Scope chain into a single map, with child bindings shadowing parents, for engines (like
+// text/template) that want an ordinary map[string]interface{} to execute against.
+func (s *Scope) flatten() map[string]interface{} {
+	flat := make(map[string]interface{})
+	var chain []*Scope
+	for sc := s; sc != nil; sc = sc.Parent {
+		chain = append(chain, sc)
+	}
+	// Walk from the outermost ancestor inward, so closer scopes overwrite farther ones.
+	for i := len(chain) - 1; i >= 0; i-- {
+		for k, v := range chain[i].Vars {
+			flat[k] = v
+		}
+	}
+	return flat
+}
+
+// TemplateEngine expands a template body into its final form, reporting any errors on the supplied diag.Sink with
+// source positions relative to doc so they can be mapped back to line/col in the original Mufile.
+type TemplateEngine interface {
+	// Name returns a human-readable name for this engine, used in diagnostics.
+	Name() string
+	// Extensions returns the file extension suffixes (e.g. ".mu.yaml.tmpl") that this engine claims.
+	Extensions() []string
+	// Expand runs the template engine over body, using scope to resolve variables, and returns the expanded
+	// result.  Errors are both returned and, when possible, reported on diag with a precise line/col.
+	Expand(doc *diag.Document, body []byte, scope *Scope, d diag.Sink) ([]byte, error)
+}
+
+// engines is the registry of known template engines, keyed by the extension suffix they claim.
+var engines = make(map[string]TemplateEngine)
+
+// RegisterEngine adds a TemplateEngine to the registry, under each of the extensions it claims.  Later
+// registrations for the same extension replace earlier ones, so callers may override the defaults below.
+func RegisterEngine(eng TemplateEngine) {
+	for _, ext := range eng.Extensions() {
+		engines[ext] = eng
+	}
+}
+
+func init() {
+	RegisterEngine(&goTemplateEngine{})
+	RegisterEngine(&mustacheEngine{})
+	RegisterEngine(&interpEngine{})
+}
+
+// EngineFor returns the template engine registered for the given file extension, if any.
+func EngineFor(ext string) (TemplateEngine, bool) {
+	eng, has := engines[ext]
+	return eng, has
+}
+
+// Expand detects whether doc.File carries a template extension and, if so, runs the matching engine over body.  If
+// no engine claims the file, body is returned unchanged.  On failure, the engine has already reported a
+// precisely-located diagnostic on d (rather than the single opaque "illegal syntax" error the marshal step alone
+// could offer), and the returned error should simply cause the caller to abort.
+func Expand(doc *diag.Document, body []byte, scope *Scope, d diag.Sink) ([]byte, error) {
+	if eng, has := engineForFile(doc.File); has {
+		return eng.Expand(doc, body, scope, d)
+	}
+	return body, nil
+}
+
+// engineForFile returns the engine registered for the most specific (longest) extension that suffixes file.
+// Some registered extensions are themselves suffixes of others (".hbs.tmpl" and ".vars.tmpl" both end in
+// ".tmpl"), so picking the first hit in map iteration order would make the choice of engine nondeterministic;
+// always preferring the longest match makes it deterministic and favors the more specific engine.
+func engineForFile(file string) (TemplateEngine, bool) {
+	var best TemplateEngine
+	bestExt := ""
+	for ext, eng := range engines {
+		if strings.HasSuffix(file, ext) && len(ext) > len(bestExt) {
+			best, bestExt = eng, ext
+		}
+	}
+	return best, best != nil
+}
+
+// goTemplateEngine expands Mufiles using Go's standard text/template engine, under the ".tmpl" extension (e.g.
+// "Mu.yaml.tmpl").
+type goTemplateEngine struct{}
+
+func (e *goTemplateEngine) Name() string         { return "go-template" }
+func (e *goTemplateEngine) Extensions() []string { return []string{".tmpl"} }
+
+func (e *goTemplateEngine) Expand(doc *diag.Document, body []byte, scope *Scope, d diag.Sink) ([]byte, error) {
+	// Without missingkey=error, an undefined variable silently renders as "<no value>" instead of failing, which
+	// would defeat the whole point of reporting per-line template diagnostics.
+	tmpl, err := template.New(doc.File).Option("missingkey=error").Parse(string(body))
+	if err != nil {
+		return nil, mapExecError(doc, d, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, scope.flatten()); err != nil {
+		return nil, mapExecError(doc, d, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// execErrorLine extracts the line number text/template embedded in msg, provided the message is reporting against
+// file.  text/template formats both parse and execution errors as `template: <file>:<line>: <msg>` (note the
+// "template: " prefix, which the file name alone does not include) and, for some parse errors, a trailing
+// `:<col>` before the final colon; only the line number immediately after the file name is extracted.  It returns
+// ok=false if msg isn't in that form, or references some other file (e.g. a template invoked via {{template}}
+// from a different file than the one we're expanding).
+func execErrorLine(file, msg string) (int, bool) {
+	prefix := "template: " + file + ":"
+	if !strings.HasPrefix(msg, prefix) {
+		return 0, false
+	}
+	rest := msg[len(prefix):]
+	end := strings.IndexByte(rest, ':')
+	if end < 0 {
+		return 0, false
+	}
+	line, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return 0, false
+	}
+	return line, true
+}
+
+// mapExecError attempts to recover a "<name>:<line>: <msg>" position out of a text/template error and report a
+// precisely-located diagnostic; if it can't, it falls back to the plain error.
+func mapExecError(doc *diag.Document, d diag.Sink, err error) error {
+	if line, ok := execErrorLine(doc.File, err.Error()); ok {
+		d.Errorf(errors.IllegalMufileSyntax.WithDocument(doc), fmt.Errorf("template error at line %d: %v", line, err))
+	}
+	return err
+}
+
+// mustacheEngine expands Mufiles under the ".hbs.tmpl" extension using the same `{{ }}` syntax as goTemplateEngine.
+// The name and extension are a nod to Mustache/Handlebars-style templates for authors coming from those tools, but
+// this is not an implementation of Handlebars: it has none of Handlebars' block helpers, partials, or other
+// extensions -- only plain Go text/template variable interpolation and control flow.
+type mustacheEngine struct{}
+
+func (e *mustacheEngine) Name() string         { return "mustache-style" }
+func (e *mustacheEngine) Extensions() []string { return []string{".hbs.tmpl"} }
+
+func (e *mustacheEngine) Expand(doc *diag.Document, body []byte, scope *Scope, d diag.Sink) ([]byte, error) {
+	// The `{{var}}` syntax this extension advertises is a subset of Go's, so we can reuse the same engine with
+	// the same variable scoping rules; only the extension (and hence user-facing framing) differs.
+	return (&goTemplateEngine{}).Expand(doc, body, scope, d)
+}
+
+// interpEngine expands simple `${var}` interpolations, under the ".vars.tmpl" extension.  It performs no control
+// flow of any kind -- just a straight substitution of variables resolved from scope.
+type interpEngine struct{}
+
+func (e *interpEngine) Name() string         { return "interp" }
+func (e *interpEngine) Extensions() []string { return []string{".vars.tmpl"} }
+
+func (e *interpEngine) Expand(doc *diag.Document, body []byte, scope *Scope, d diag.Sink) ([]byte, error) {
+	s := string(body)
+	line := 1
+	var out bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch == '\n' {
+			line++
+		}
+		if ch == '$' && i+1 < len(s) && s[i+1] == '{' {
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				err := fmt.Errorf("unterminated ${...} interpolation at line %d", line)
+				d.Errorf(errors.IllegalMufileSyntax.WithDocument(doc), err)
+				return nil, err
+			}
+			name := strings.TrimSpace(s[i+2 : i+2+end])
+			v, has := scope.Lookup(name)
+			if !has {
+				err := fmt.Errorf("undefined variable %q at line %d", name, line)
+				d.Errorf(errors.IllegalMufileSyntax.WithDocument(doc), err)
+				return nil, err
+			}
+			fmt.Fprintf(&out, "%v", v)
+			i += 2 + end
+			continue
+		}
+		out.WriteByte(ch)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Marapongo, Inc. All rights reserved.
+
+package template
+
+import "testing"
+
+func TestExecErrorLine(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		msg      string
+		wantLine int
+		wantOK   bool
+	}{
+		{
+			name:     "execution error",
+			file:     "Mu.yaml.tmpl",
+			msg:      `template: Mu.yaml.tmpl:3: map has no entry for key "missing"`,
+			wantLine: 3,
+			wantOK:   true,
+		},
+		{
+			name:     "parse error with column",
+			file:     "Mu.yaml.tmpl",
+			msg:      `template: Mu.yaml.tmpl:12:5: unexpected "}" in operand`,
+			wantLine: 12,
+			wantOK:   true,
+		},
+		{
+			name:   "unrelated error has no position to recover",
+			file:   "Mu.yaml.tmpl",
+			msg:    "some unrelated error with no position",
+			wantOK: false,
+		},
+		{
+			name:   "position for a different file is not claimed as ours",
+			file:   "Mu.yaml.tmpl",
+			msg:    `template: other.tmpl:3: map has no entry for key "x"`,
+			wantOK: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			line, ok := execErrorLine(c.file, c.msg)
+			if ok != c.wantOK {
+				t.Fatalf("execErrorLine(%q, %q) ok = %v, want %v", c.file, c.msg, ok, c.wantOK)
+			}
+			if ok && line != c.wantLine {
+				t.Fatalf("execErrorLine(%q, %q) line = %v, want %v", c.file, c.msg, line, c.wantLine)
+			}
+		})
+	}
+}
+
+func TestEngineForFile(t *testing.T) {
+	cases := []struct {
+		file       string
+		wantEngine string
+		wantFound  bool
+	}{
+		{file: "Mu.yaml.tmpl", wantEngine: "go-template", wantFound: true},
+		{file: "Mu.yaml.hbs.tmpl", wantEngine: "mustache-style", wantFound: true},
+		{file: "Mu.yaml.vars.tmpl", wantEngine: "interp", wantFound: true},
+		{file: "Mu.yaml", wantFound: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.file, func(t *testing.T) {
+			eng, found := engineForFile(c.file)
+			if found != c.wantFound {
+				t.Fatalf("engineForFile(%q) found = %v, want %v", c.file, found, c.wantFound)
+			}
+			if found && eng.Name() != c.wantEngine {
+				t.Fatalf("engineForFile(%q) = %q, want %q", c.file, eng.Name(), c.wantEngine)
+			}
+		})
+	}
+}
+
+func TestScopePushOverridesParent(t *testing.T) {
+	root := NewScope(map[string]interface{}{"a": "root-a", "b": "root-b"})
+	child := root.Push(map[string]interface{}{"a": "child-a"})
+
+	if v, _ := child.Lookup("a"); v != "child-a" {
+		t.Fatalf("child scope should override parent's \"a\", got %v", v)
+	}
+	if v, _ := child.Lookup("b"); v != "root-b" {
+		t.Fatalf("child scope should inherit parent's \"b\", got %v", v)
+	}
+	if _, has := child.Lookup("missing"); has {
+		t.Fatalf("expected lookup of an undefined variable to fail")
+	}
+}
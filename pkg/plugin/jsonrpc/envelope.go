@@ -0,0 +1,257 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+// Package jsonrpc bridges the resource provider gRPC surface (Check/Diff/Create/Update/Delete) over HTTP+JSON, so
+// that tools which can't (or don't want to) link gRPC -- CLIs, editors, dashboards -- may drive a provider plugin
+// using ordinary HTTP requests.  The wire encoding intentionally mirrors the semantics of
+// plugin.MarshalPropertiesWithUnknowns/UnmarshalProperties so that a PropertyMap marshaled through either path is
+// semantically identical: unknown/computed values become a sentinel string alongside a side-channel "unknowns"
+// list, Asset/Archive values round-trip through their Serialize() form, and SkipNulls is honored identically.
+package jsonrpc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pulumi/lumi/pkg/resource"
+	"github.com/pulumi/lumi/pkg/resource/plugin"
+	"github.com/pulumi/lumi/pkg/util/contract"
+)
+
+// UnknownSentinel is substituted for any unknown (computed) property value in the JSON encoding.  The
+// corresponding key is also recorded in the envelope's Unknowns list, mirroring the side-channel map that
+// plugin.MarshalPropertiesWithUnknowns returns to its gRPC caller.
+const UnknownSentinel = "@@unknown@@"
+
+// secretSentinelKey marks a JSON object as a wrapped secret value, mirroring plugin.MarshalSecret's tagged
+// struct; its sibling "ciphertext" field carries the base64-encoded encrypted inner value.
+const secretSentinelKey = "@@secret@@"
+
+// PropertyMapEnvelope is the JSON-over-HTTP equivalent of the *structpb.Struct plus side-channel "unknowns" map
+// that plugin.MarshalPropertiesWithUnknowns produces for the gRPC wire.
+type PropertyMapEnvelope struct {
+	Properties map[string]interface{} `json:"properties"`
+	Unknowns   []string                `json:"unknowns,omitempty"`
+}
+
+// MarshalPropertyMap converts a resource.PropertyMap into its JSON envelope form, using the same unknown, null,
+// and Asset/Archive handling rules as plugin.MarshalPropertiesWithUnknowns.
+func MarshalPropertyMap(props resource.PropertyMap, opts plugin.MarshalOptions) (*PropertyMapEnvelope, error) {
+	env := &PropertyMapEnvelope{Properties: make(map[string]interface{})}
+	for _, key := range props.StableKeys() {
+		v := props[key]
+		if v.IsOutput() {
+			continue // gRPC's MarshalPropertiesWithUnknowns skips output properties too.
+		} else if opts.SkipNulls && v.IsNull() {
+			continue
+		}
+
+		jv, known, err := marshalPropertyValue(v, opts)
+		if err != nil {
+			return nil, err
+		}
+		env.Properties[string(key)] = jv
+		if !known {
+			env.Unknowns = append(env.Unknowns, string(key))
+		}
+	}
+	return env, nil
+}
+
+// marshalPropertyValue converts a single property value to its JSON representation, reporting whether it was
+// known (true) or a computed/unknown placeholder (false), exactly as plugin.MarshalPropertyValue does for gRPC.
+func marshalPropertyValue(v resource.PropertyValue, opts plugin.MarshalOptions) (interface{}, bool, error) {
+	switch {
+	case v.IsNull():
+		return nil, true, nil
+	case v.IsBool():
+		return v.BoolValue(), true, nil
+	case v.IsNumber():
+		return v.NumberValue(), true, nil
+	case v.IsString():
+		return v.StringValue(), true, nil
+	case v.IsArray():
+		known := true
+		elems := make([]interface{}, 0, len(v.ArrayValue()))
+		for _, elem := range v.ArrayValue() {
+			jv, elemKnown, err := marshalPropertyValue(elem, opts)
+			if err != nil {
+				return nil, false, err
+			}
+			elems = append(elems, jv)
+			known = known && elemKnown
+		}
+		return elems, known, nil
+	case v.IsAsset():
+		return v.AssetValue().Serialize(), true, nil
+	case v.IsArchive():
+		return v.ArchiveValue().Serialize(), true, nil
+	case v.IsSecret():
+		return marshalSecretValue(v.SecretValue(), opts)
+	case v.IsObject():
+		env, err := MarshalPropertyMap(v.ObjectValue(), opts)
+		if err != nil {
+			return nil, false, err
+		}
+		return env.Properties, len(env.Unknowns) == 0, nil
+	case v.IsComputed():
+		e := v.ComputedValue().Element
+		contract.Assert(!e.IsComputed())
+		return UnknownSentinel, false, nil
+	case v.IsOutput():
+		e := v.OutputValue().Element
+		contract.Assert(!e.IsComputed())
+		jv, _, err := marshalPropertyValue(e, opts)
+		return jv, false, err
+	default:
+		return nil, false, fmt.Errorf("unrecognized property value: %v", v.V)
+	}
+}
+
+// marshalSecretValue marshals a secret property's inner element and, when opts.KeepSecrets is set, wraps the
+// result in the `{"@@secret@@": true, "ciphertext": "..."}` tagged object using opts.Cipher, mirroring
+// plugin.MarshalSecret's wire form for the gRPC path.  When KeepSecrets is false, the wrapper is dropped and the
+// plaintext inner value is returned instead, for callers that don't understand secrets.
+func marshalSecretValue(s *resource.Secret, opts plugin.MarshalOptions) (interface{}, bool, error) {
+	inner, known, err := marshalPropertyValue(s.Element, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if !opts.KeepSecrets {
+		return inner, known, nil
+	}
+
+	contract.Assert(opts.Cipher != nil)
+	plaintext, err := json.Marshal(inner)
+	if err != nil {
+		return nil, false, err
+	}
+	ciphertext, err := opts.Cipher.Encrypt(plaintext)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Ciphertext is arbitrary binary; base64 it so it survives being embedded in a JSON string.
+	return map[string]interface{}{
+		secretSentinelKey: true,
+		"ciphertext":      base64.StdEncoding.EncodeToString(ciphertext),
+	}, known, nil
+}
+
+// unmarshalSecretValue reverses marshalSecretValue: it base64-decodes and decrypts the ciphertext, unmarshals the
+// resulting JSON back into a property value, and re-wraps it as secret.
+func unmarshalSecretValue(t map[string]interface{}, opts plugin.MarshalOptions) (resource.PropertyValue, error) {
+	contract.Assert(opts.Cipher != nil)
+
+	ctStr, _ := t["ciphertext"].(string)
+	ciphertext, err := base64.StdEncoding.DecodeString(ctStr)
+	if err != nil {
+		return resource.PropertyValue{}, err
+	}
+
+	plaintext, err := opts.Cipher.Decrypt(ciphertext)
+	if err != nil {
+		return resource.PropertyValue{}, err
+	}
+
+	var inner interface{}
+	if err := json.Unmarshal(plaintext, &inner); err != nil {
+		return resource.PropertyValue{}, err
+	}
+
+	v, err := unmarshalPropertyValue(inner, opts)
+	if err != nil {
+		return resource.PropertyValue{}, err
+	}
+	return resource.MakeSecret(v), nil
+}
+
+// UnmarshalPropertyMap converts a JSON envelope back into a resource.PropertyMap.  Keys listed in env.Unknowns
+// are restored as PropertyComputed values, matching how a gRPC caller would interpret the unknowns side-channel.
+func UnmarshalPropertyMap(env *PropertyMapEnvelope, opts plugin.MarshalOptions) (resource.PropertyMap, error) {
+	unk := make(map[string]bool, len(env.Unknowns))
+	for _, k := range env.Unknowns {
+		unk[k] = true
+	}
+
+	result := make(resource.PropertyMap)
+	for k, jv := range env.Properties {
+		if unk[k] {
+			result[resource.PropertyKey(k)] = resource.MakeComputed(resource.NewStringProperty(""))
+			continue
+		}
+		v, err := unmarshalPropertyValue(jv, opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.SkipNulls && v.IsNull() {
+			continue
+		}
+		result[resource.PropertyKey(k)] = v
+	}
+	return result, nil
+}
+
+func unmarshalPropertyValue(jv interface{}, opts plugin.MarshalOptions) (resource.PropertyValue, error) {
+	switch t := jv.(type) {
+	case nil:
+		return resource.NewNullProperty(), nil
+	case bool:
+		return resource.NewBoolProperty(t), nil
+	case float64:
+		return resource.NewNumberProperty(t), nil
+	case string:
+		if t == UnknownSentinel {
+			return resource.MakeComputed(resource.NewStringProperty("")), nil
+		}
+		return resource.NewStringProperty(t), nil
+	case []interface{}:
+		elems := make([]resource.PropertyValue, len(t))
+		for i, elem := range t {
+			ev, err := unmarshalPropertyValue(elem, opts)
+			if err != nil {
+				return resource.PropertyValue{}, err
+			}
+			elems[i] = ev
+		}
+		return resource.NewArrayProperty(elems), nil
+	case map[string]interface{}:
+		if tag, has := t[secretSentinelKey]; has {
+			if isSecret, _ := tag.(bool); isSecret {
+				return unmarshalSecretValue(t, opts)
+			}
+		}
+
+		obj, err := UnmarshalPropertyMap(&PropertyMapEnvelope{Properties: t}, opts)
+		if err != nil {
+			return resource.PropertyValue{}, err
+		}
+		objmap := obj.Mappable()
+		if asset, isasset := resource.DeserializeAsset(objmap); isasset {
+			return resource.NewAssetProperty(asset), nil
+		} else if archive, isarchive := resource.DeserializeArchive(objmap); isarchive {
+			return resource.NewArchiveProperty(archive), nil
+		}
+		return resource.NewObjectProperty(obj), nil
+	default:
+		return resource.PropertyValue{}, fmt.Errorf("unrecognized JSON value of type %T", jv)
+	}
+}
+
+// Marshal is a convenience wrapper that encodes a PropertyMapEnvelope as JSON bytes.
+func Marshal(props resource.PropertyMap, opts plugin.MarshalOptions) ([]byte, error) {
+	env, err := MarshalPropertyMap(props, opts)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// Unmarshal is a convenience wrapper that decodes JSON bytes into a resource.PropertyMap.
+func Unmarshal(data []byte, opts plugin.MarshalOptions) (resource.PropertyMap, error) {
+	var env PropertyMapEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	return UnmarshalPropertyMap(&env, opts)
+}
@@ -0,0 +1,99 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package jsonrpc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pulumi/lumi/pkg/resource"
+	"github.com/pulumi/lumi/pkg/resource/plugin"
+)
+
+// testProps returns a PropertyMap exercising every value kind the gRPC and JSON marshaling paths both claim to
+// support, so that a conformance test comparing the two has something to disagree about if they ever drift.
+func testProps() resource.PropertyMap {
+	return resource.NewPropertyMapFromMap(map[string]interface{}{
+		"nothing": nil,
+		"flag":    true,
+		"count":   42.0,
+		"name":    "a property value",
+		"tags":    []interface{}{"a", "b", "c"},
+		"nested": map[string]interface{}{
+			"inner": "value",
+		},
+	})
+}
+
+// TestConformanceRoundTrip marshals the same PropertyMap through both the gRPC wire representation
+// (plugin.MarshalPropertiesWithUnknowns/UnmarshalProperties) and the JSON gateway envelope
+// (MarshalPropertyMap/UnmarshalPropertyMap) and asserts that unmarshaling either one back produces a semantically
+// identical PropertyMap.  The two paths are maintained independently, so this is what actually catches one of them
+// drifting out of sync with the other's handling of unknowns, nulls, or composite values.
+func TestConformanceRoundTrip(t *testing.T) {
+	props := testProps()
+	opts := plugin.MarshalOptions{}
+
+	pbStruct, err := plugin.MarshalProperties(props, opts)
+	if err != nil {
+		t.Fatalf("plugin.MarshalProperties failed: %v", err)
+	}
+	fromPB, err := plugin.UnmarshalProperties(pbStruct, opts)
+	if err != nil {
+		t.Fatalf("plugin.UnmarshalProperties failed: %v", err)
+	}
+
+	env, err := MarshalPropertyMap(props, opts)
+	if err != nil {
+		t.Fatalf("MarshalPropertyMap failed: %v", err)
+	}
+	fromJSON, err := UnmarshalPropertyMap(env, opts)
+	if err != nil {
+		t.Fatalf("UnmarshalPropertyMap failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(fromPB, fromJSON) {
+		t.Fatalf("gRPC and JSON round trips disagree:\ngRPC: %#v\nJSON: %#v", fromPB, fromJSON)
+	}
+}
+
+// TestConformanceRoundTripSecret is TestConformanceRoundTrip's secret-value counterpart: it confirms that a secret
+// property, once encrypted and wrapped for the wire by either path, still decrypts back to the same plaintext
+// PropertyMap via the other path's unmarshaler expectations.
+func TestConformanceRoundTripSecret(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	cipher := plugin.NewAESGCMCipher(key)
+
+	props := testProps()
+	props["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+	opts := plugin.MarshalOptions{KeepSecrets: true, Cipher: cipher}
+
+	pbStruct, err := plugin.MarshalProperties(props, opts)
+	if err != nil {
+		t.Fatalf("plugin.MarshalProperties failed: %v", err)
+	}
+	fromPB, err := plugin.UnmarshalProperties(pbStruct, opts)
+	if err != nil {
+		t.Fatalf("plugin.UnmarshalProperties failed: %v", err)
+	}
+
+	env, err := MarshalPropertyMap(props, opts)
+	if err != nil {
+		t.Fatalf("MarshalPropertyMap failed: %v", err)
+	}
+	fromJSON, err := UnmarshalPropertyMap(env, opts)
+	if err != nil {
+		t.Fatalf("UnmarshalPropertyMap failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(fromPB, fromJSON) {
+		t.Fatalf("gRPC and JSON secret round trips disagree:\ngRPC: %#v\nJSON: %#v", fromPB, fromJSON)
+	}
+	if !fromJSON["password"].IsSecret() {
+		t.Fatalf("expected password to remain marked secret after round tripping")
+	}
+	if fromJSON["password"].SecretValue().Element.StringValue() != "hunter2" {
+		t.Fatalf("secret round trip produced wrong plaintext: %v", fromJSON["password"].SecretValue().Element)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/pulumi/lumi/pkg/resource"
+	"github.com/pulumi/lumi/pkg/resource/plugin"
+	"github.com/pulumi/lumi/pkg/tokens"
+)
+
+// CheckRequest carries the arguments for a Check RPC: the resource's URN and its (possibly partial) property bag.
+type CheckRequest struct {
+	URN  tokens.URN           `json:"urn"`
+	News *PropertyMapEnvelope `json:"news"`
+}
+
+// CheckResponse carries the normalized properties and any failures discovered during a Check RPC.
+type CheckResponse struct {
+	Defaults *PropertyMapEnvelope `json:"defaults,omitempty"`
+	Failures []string             `json:"failures,omitempty"`
+}
+
+// DiffRequest carries the old and new property bags to compare for a Diff RPC.
+type DiffRequest struct {
+	URN  tokens.URN           `json:"urn"`
+	ID   resource.ID          `json:"id"`
+	Olds *PropertyMapEnvelope `json:"olds"`
+	News *PropertyMapEnvelope `json:"news"`
+}
+
+// DiffResponse reports whether a resource must be replaced and which properties changed.
+type DiffResponse struct {
+	Replaces []string `json:"replaces,omitempty"`
+	Changes  []string `json:"changes,omitempty"`
+}
+
+// CreateRequest carries the properties to use when creating a new resource.
+type CreateRequest struct {
+	URN  tokens.URN           `json:"urn"`
+	News *PropertyMapEnvelope `json:"news"`
+}
+
+// CreateResponse reports the ID and any output properties produced by the new resource.
+type CreateResponse struct {
+	ID      resource.ID          `json:"id"`
+	Outputs *PropertyMapEnvelope `json:"outputs,omitempty"`
+}
+
+// UpdateRequest carries the old and new properties to use when updating an existing resource.
+type UpdateRequest struct {
+	URN  tokens.URN           `json:"urn"`
+	ID   resource.ID          `json:"id"`
+	Olds *PropertyMapEnvelope `json:"olds"`
+	News *PropertyMapEnvelope `json:"news"`
+}
+
+// UpdateResponse reports any output properties produced by the update.
+type UpdateResponse struct {
+	Outputs *PropertyMapEnvelope `json:"outputs,omitempty"`
+}
+
+// DeleteRequest carries the resource to delete.
+type DeleteRequest struct {
+	URN  tokens.URN           `json:"urn"`
+	ID   resource.ID          `json:"id"`
+	Olds *PropertyMapEnvelope `json:"olds"`
+}
+
+// ProviderClient is the subset of the generated pulumirpc.ResourceProviderClient surface that the gateway drives.
+// It is expressed in terms of our own request/response types (rather than the *.pb.go structs) so that the HTTP
+// layer below depends only on this package; NewGatewayFromProvider (in genproxy.go) adapts an actual gRPC client
+// to this interface.
+type ProviderClient interface {
+	Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error)
+	Diff(ctx context.Context, req *DiffRequest) (*DiffResponse, error)
+	Create(ctx context.Context, req *CreateRequest) (*CreateResponse, error)
+	Update(ctx context.Context, req *UpdateRequest) (*UpdateResponse, error)
+	Delete(ctx context.Context, req *DeleteRequest) error
+}
+
+// Gateway is an http.Handler that exposes a ProviderClient's Check/Diff/Create/Update/Delete methods as JSON-over-
+// HTTP endpoints, so that tools which cannot link gRPC may drive a resource provider plugin directly.
+type Gateway struct {
+	client ProviderClient
+	opts   plugin.MarshalOptions
+}
+
+// NewGateway creates a Gateway that proxies requests to the given provider client, marshaling properties using opts.
+func NewGateway(client ProviderClient, opts plugin.MarshalOptions) *Gateway {
+	return &Gateway{client: client, opts: opts}
+}
+
+// ServeHTTP dispatches POST requests for /check, /diff, /create, /update, and /delete to the wrapped
+// ProviderClient, translating JSON request/response bodies using the envelope rules in envelope.go.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/check":
+		var req CheckRequest
+		g.serve(w, r, &req, func(ctx context.Context) (interface{}, error) { return g.client.Check(ctx, &req) })
+	case "/diff":
+		var req DiffRequest
+		g.serve(w, r, &req, func(ctx context.Context) (interface{}, error) { return g.client.Diff(ctx, &req) })
+	case "/create":
+		var req CreateRequest
+		g.serve(w, r, &req, func(ctx context.Context) (interface{}, error) { return g.client.Create(ctx, &req) })
+	case "/update":
+		var req UpdateRequest
+		g.serve(w, r, &req, func(ctx context.Context) (interface{}, error) { return g.client.Update(ctx, &req) })
+	case "/delete":
+		var req DeleteRequest
+		g.serve(w, r, &req, func(ctx context.Context) (interface{}, error) { return nil, g.client.Delete(ctx, &req) })
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serve decodes the request body into req, invokes fn (which is expected to use req by closure), and writes the
+// result back as JSON.  A nil, nil result (as Delete returns) is reported as 204 No Content rather than an empty
+// JSON body.
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request, req interface{}, fn func(context.Context) (interface{}, error)) {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := fn(r.Context())
+	if err != nil {
+		glog.V(7).Infof("jsonrpc gateway call failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		glog.V(7).Infof("jsonrpc gateway: failed writing response: %v", err)
+	}
+}
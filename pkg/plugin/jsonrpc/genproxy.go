@@ -0,0 +1,267 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package jsonrpc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// rpcMethod describes a single `rpc Name(Req) returns (Resp)` line lifted from a .proto service definition.
+type rpcMethod struct {
+	Name     string
+	Request  string
+	Response string
+}
+
+// rpcPattern matches lines of the form `rpc Check(CheckRequest) returns (CheckResponse);` (optionally with
+// trailing `{}` for a method with options), which is all we need to generate an adapter.
+var rpcPattern = regexp.MustCompile(`^\s*rpc\s+(\w+)\s*\(\s*(\w+)\s*\)\s*returns\s*\(\s*(\w+)\s*\)\s*[;{]`)
+
+// parseServiceMethods scans proto for `rpc` lines belonging to the named service and returns the methods found.
+// It is a deliberately small, line-oriented scanner rather than a full .proto parser: the resource provider
+// service definition is simple enough (one rpc per line, no nested services) that this is sufficient, and it
+// avoids taking a dependency on a full protobuf IDL parser just to generate gateway glue.
+func parseServiceMethods(proto io.Reader, service string) ([]rpcMethod, error) {
+	var methods []rpcMethod
+	inService := false
+	depth := 0
+
+	scanner := bufio.NewScanner(proto)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if !inService {
+			if strings.HasPrefix(trimmed, "service "+service) {
+				inService = true
+				depth = strings.Count(line, "{") - strings.Count(line, "}")
+			}
+			continue
+		}
+
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		if m := rpcPattern.FindStringSubmatch(trimmed); m != nil {
+			methods = append(methods, rpcMethod{Name: m[1], Request: m[2], Response: m[3]})
+		}
+		if depth <= 0 {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// fieldKind describes how a single field should be translated between a jsonrpc request/response struct (defined
+// in gateway.go) and its pb counterpart (as emitted by protoc-gen-go from the same .proto this package reads).
+type fieldKind int
+
+const (
+	fieldCopy  fieldKind = iota // copy the field verbatim (e.g. []string Failures/Replaces/Changes).
+	fieldURN                    // jsonrpc tokens.URN <-> pb string.
+	fieldID                     // jsonrpc resource.ID <-> pb string.
+	fieldProps                  // jsonrpc *PropertyMapEnvelope <-> pb *structpb.Struct, via PropertyMap.
+)
+
+// fieldMapping pairs a jsonrpc struct field with its pb counterpart and how to translate between them.
+type fieldMapping struct {
+	JSONField string
+	PBField   string
+	Kind      fieldKind
+}
+
+// methodShape describes the known, conventional Urn/Id/Olds/News/Properties shape that every resource provider
+// RPC in this codebase follows.  parseServiceMethods only tells us method and message type *names*; it can't know
+// field names or types without a full .proto message parser, so translation is only generated for the methods we
+// already know the shape of (the same five modeled by ProviderClient in gateway.go).  Anything else produces a
+// clearly-failing stub rather than silently-wrong generated code.
+var methodShapes = map[string]struct {
+	Request  []fieldMapping
+	Response []fieldMapping
+}{
+	"Check": {
+		Request:  []fieldMapping{{"URN", "Urn", fieldURN}, {"News", "News", fieldProps}},
+		Response: []fieldMapping{{"Defaults", "Defaults", fieldProps}, {"Failures", "Failures", fieldCopy}},
+	},
+	"Diff": {
+		Request: []fieldMapping{
+			{"URN", "Urn", fieldURN}, {"ID", "Id", fieldID}, {"Olds", "Olds", fieldProps}, {"News", "News", fieldProps},
+		},
+		Response: []fieldMapping{{"Replaces", "Replaces", fieldCopy}, {"Changes", "Changes", fieldCopy}},
+	},
+	"Create": {
+		Request:  []fieldMapping{{"URN", "Urn", fieldURN}, {"News", "News", fieldProps}},
+		Response: []fieldMapping{{"ID", "Id", fieldID}, {"Outputs", "Properties", fieldProps}},
+	},
+	"Update": {
+		Request: []fieldMapping{
+			{"URN", "Urn", fieldURN}, {"ID", "Id", fieldID}, {"Olds", "Olds", fieldProps}, {"News", "News", fieldProps},
+		},
+		Response: []fieldMapping{{"Outputs", "Properties", fieldProps}},
+	},
+	"Delete": {
+		Request:  []fieldMapping{{"URN", "Urn", fieldURN}, {"ID", "Id", fieldID}, {"Olds", "Properties", fieldProps}},
+		Response: nil,
+	},
+}
+
+// GenerateGatewayAdapter reads a ResourceProvider .proto service definition from proto and writes a Go source
+// file to out that adapts the generated gRPC client to the ProviderClient interface above.  This is the
+// "reverse proxy generator": rather than hand-maintaining the gRPC<->JSON glue whenever the .proto changes, it is
+// regenerated from the same source of truth the gRPC stubs themselves come from.
+//
+// Translation is only generated for methods matching the conventional Urn/Id/Olds/News/Properties shape
+// described by methodShapes (i.e. Check/Diff/Create/Update/Delete); any other method in the service produces a
+// method body that returns a descriptive error at call time instead of guessed-at, possibly-wrong glue code.
+func GenerateGatewayAdapter(proto io.Reader, service string, pbPkg string, pkg string, out io.Writer) error {
+	methods, err := parseServiceMethods(proto, service)
+	if err != nil {
+		return err
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("no rpc methods found for service %q", service)
+	}
+	hasUnknown := false
+	for _, m := range methods {
+		if _, known := methodShapes[m.Name]; !known {
+			hasUnknown = true
+		}
+	}
+
+	fmt.Fprintf(out, "// Code generated by jsonrpc.GenerateGatewayAdapter from %s; DO NOT EDIT.\n\n", service)
+	fmt.Fprintf(out, "package %s\n\n", pkg)
+	fmt.Fprintln(out, `import (`)
+	fmt.Fprintln(out, `	"context"`)
+	if hasUnknown {
+		fmt.Fprintln(out, `	"fmt"`)
+	}
+	fmt.Fprintln(out, ``)
+	fmt.Fprintf(out, "\t%s \"%s\"\n", pbPkg, pbPkg)
+	fmt.Fprintln(out, `	"github.com/pulumi/lumi/pkg/plugin/jsonrpc"`)
+	fmt.Fprintln(out, `	"github.com/pulumi/lumi/pkg/resource/plugin"`)
+	fmt.Fprintln(out, `)`)
+	fmt.Fprintln(out)
+
+	fmt.Fprintf(out, "// grpcAdapter adapts a generated %s client to jsonrpc.ProviderClient.\n", service)
+	fmt.Fprintln(out, "type grpcAdapter struct {")
+	fmt.Fprintf(out, "\tclient %s.%sClient\n", pbPkg, service)
+	fmt.Fprintln(out, "\topts   plugin.MarshalOptions")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "// NewGrpcAdapter wraps a generated %s gRPC client for use with jsonrpc.NewGateway.\n", service)
+	fmt.Fprintf(out, "func NewGrpcAdapter(client %s.%sClient, opts plugin.MarshalOptions) jsonrpc.ProviderClient {\n",
+		pbPkg, service)
+	fmt.Fprintln(out, "\treturn &grpcAdapter{client: client, opts: opts}")
+	fmt.Fprintln(out, "}")
+
+	for _, m := range methods {
+		shape, known := methodShapes[m.Name]
+		fmt.Fprintln(out)
+		if !known {
+			writeUnknownMethod(out, m)
+			continue
+		}
+		if m.Name == "Delete" {
+			writeDeleteMethod(out, m, pbPkg, shape.Request)
+			continue
+		}
+		writeKnownMethod(out, m, pbPkg, shape.Request, shape.Response)
+	}
+
+	return nil
+}
+
+// writeUnknownMethod emits a method body for an RPC whose field shape we don't know how to translate, so that
+// calling it fails loudly and specifically instead of silently doing the wrong thing.
+func writeUnknownMethod(out io.Writer, m rpcMethod) {
+	fmt.Fprintf(out, "func (a *grpcAdapter) %s(ctx context.Context, req *jsonrpc.%sRequest) (*jsonrpc.%sResponse, error) {\n",
+		m.Name, m.Name, m.Name)
+	fmt.Fprintf(out, "\treturn nil, fmt.Errorf(%q)\n",
+		fmt.Sprintf("jsonrpc: no known field mapping for %s(%s) returns (%s); regenerate with an explicit shape", m.Name, m.Request, m.Response))
+	fmt.Fprintln(out, "}")
+}
+
+func writeKnownMethod(out io.Writer, m rpcMethod, pbPkg string, reqFields, respFields []fieldMapping) {
+	fmt.Fprintf(out, "func (a *grpcAdapter) %s(ctx context.Context, req *jsonrpc.%sRequest) (*jsonrpc.%sResponse, error) {\n",
+		m.Name, m.Name, m.Name)
+	fmt.Fprintf(out, "\tpbReq := &%s.%s{}\n", pbPkg, m.Request)
+	for _, f := range reqFields {
+		writeFieldToPB(out, "req", "pbReq", "return nil, err", f)
+	}
+	fmt.Fprintf(out, "\tpbResp, err := a.client.%s(ctx, pbReq)\n", m.Name)
+	fmt.Fprintln(out, "\tif err != nil {")
+	fmt.Fprintln(out, "\t\treturn nil, err")
+	fmt.Fprintln(out, "\t}")
+	fmt.Fprintf(out, "\tresp := &jsonrpc.%sResponse{}\n", m.Name)
+	for _, f := range respFields {
+		writeFieldFromPB(out, "pbResp", "resp", f)
+	}
+	fmt.Fprintln(out, "\treturn resp, nil")
+	fmt.Fprintln(out, "}")
+}
+
+func writeDeleteMethod(out io.Writer, m rpcMethod, pbPkg string, reqFields []fieldMapping) {
+	fmt.Fprintln(out, "func (a *grpcAdapter) Delete(ctx context.Context, req *jsonrpc.DeleteRequest) error {")
+	fmt.Fprintf(out, "\tpbReq := &%s.%s{}\n", pbPkg, m.Request)
+	for _, f := range reqFields {
+		writeFieldToPB(out, "req", "pbReq", "return err", f)
+	}
+	fmt.Fprintln(out, "\t_, err := a.client.Delete(ctx, pbReq)")
+	fmt.Fprintln(out, "\treturn err")
+	fmt.Fprintln(out, "}")
+}
+
+// writeFieldToPB emits the statement(s) that copy one field from a jsonrpc request struct into its pb
+// counterpart, converting *PropertyMapEnvelope <-> *structpb.Struct via the same MarshalProperties/
+// UnmarshalProperties semantics the rest of this package's marshaling relies on.  errReturn is the literal
+// `return ...` statement to emit on a marshaling failure; it's parameterized because callers don't all share the
+// same method signature (e.g. Delete returns a bare error, unlike the other RPCs' (*Response, error)).
+func writeFieldToPB(out io.Writer, jsonVar, pbVar, errReturn string, f fieldMapping) {
+	switch f.Kind {
+	case fieldURN:
+		fmt.Fprintf(out, "\t%s.%s = string(%s.%s)\n", pbVar, f.PBField, jsonVar, f.JSONField)
+	case fieldID:
+		fmt.Fprintf(out, "\t%s.%s = string(%s.%s)\n", pbVar, f.PBField, jsonVar, f.JSONField)
+	case fieldProps:
+		fmt.Fprintf(out, "\tif %s.%s != nil {\n", jsonVar, f.JSONField)
+		fmt.Fprintf(out, "\t\tprops, err := jsonrpc.UnmarshalPropertyMap(%s.%s, a.opts)\n", jsonVar, f.JSONField)
+		fmt.Fprintln(out, "\t\tif err != nil {")
+		fmt.Fprintf(out, "\t\t\t%s\n", errReturn)
+		fmt.Fprintln(out, "\t\t}")
+		fmt.Fprintf(out, "\t\tpbProps, err := plugin.MarshalProperties(props, a.opts)\n")
+		fmt.Fprintln(out, "\t\tif err != nil {")
+		fmt.Fprintf(out, "\t\t\t%s\n", errReturn)
+		fmt.Fprintln(out, "\t\t}")
+		fmt.Fprintf(out, "\t\t%s.%s = pbProps\n", pbVar, f.PBField)
+		fmt.Fprintln(out, "\t}")
+	case fieldCopy:
+		fmt.Fprintf(out, "\t%s.%s = %s.%s\n", pbVar, f.PBField, jsonVar, f.JSONField)
+	}
+}
+
+// writeFieldFromPB is writeFieldToPB's mirror image, populating a jsonrpc response struct from a pb response.
+func writeFieldFromPB(out io.Writer, pbVar, jsonVar string, f fieldMapping) {
+	switch f.Kind {
+	case fieldURN, fieldID:
+		fmt.Fprintf(out, "\t%s.%s = %s.%s\n", jsonVar, f.JSONField, pbVar, f.PBField)
+	case fieldProps:
+		fmt.Fprintf(out, "\tif %s.%s != nil {\n", pbVar, f.PBField)
+		fmt.Fprintf(out, "\t\tprops, err := plugin.UnmarshalProperties(%s.%s, a.opts)\n", pbVar, f.PBField)
+		fmt.Fprintln(out, "\t\tif err != nil {")
+		fmt.Fprintln(out, "\t\t\treturn nil, err")
+		fmt.Fprintln(out, "\t\t}")
+		fmt.Fprintf(out, "\t\tenv, err := jsonrpc.MarshalPropertyMap(props, a.opts)\n")
+		fmt.Fprintln(out, "\t\tif err != nil {")
+		fmt.Fprintln(out, "\t\t\treturn nil, err")
+		fmt.Fprintln(out, "\t\t}")
+		fmt.Fprintf(out, "\t\t%s.%s = env\n", jsonVar, f.JSONField)
+		fmt.Fprintln(out, "\t}")
+	case fieldCopy:
+		fmt.Fprintf(out, "\t%s.%s = %s.%s\n", jsonVar, f.JSONField, pbVar, f.PBField)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/glog"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	"github.com/pulumi/lumi/pkg/resource"
+	"github.com/pulumi/lumi/pkg/util/contract"
+)
+
+// transferChunkSize is the size, in bytes, of each BlobChunk sent over the TransferBlob streaming RPC.
+const transferChunkSize = 64 * 1024
+
+// StreamThreshold is the content size, in bytes, beyond which MarshalAsset/MarshalArchive will -- when
+// MarshalOptions.StreamLargeBlobs is set -- store the payload in a BlobStore and emit a reference instead of
+// inlining the bytes into the RPC.  It is comfortably under gRPC's default 4MB message limit to leave headroom
+// for the rest of the request.
+const StreamThreshold = 3 * 1024 * 1024
+
+// BlobRef is a content-addressed reference to a blob previously stored in a BlobStore: two assets or archives
+// with identical bytes always produce the same BlobRef, which is what lets a BlobStore de-duplicate transfers of
+// the same content across resources for free.
+type BlobRef string
+
+// BlobStore lets large asset/archive payloads be transferred out-of-band instead of being inlined into the
+// ordinary property RPCs.  Implementations are expected to be content-addressed: Put must return the same
+// BlobRef for identical content so callers get de-duplication without any extra bookkeeping.
+type BlobStore interface {
+	// Put stores the content read from r and returns a content-addressed reference to it.
+	Put(r io.Reader) (BlobRef, error)
+	// Get retrieves the content previously stored under ref.
+	Get(ref BlobRef) (io.ReadCloser, error)
+}
+
+// NewInMemoryBlobStore returns a BlobStore that keeps all content in memory, keyed by its sha256 digest.  It is
+// suitable for tests and for a single long-lived engine process; a production deployment will typically back
+// BlobStore with local disk or a content-addressed object store instead.
+func NewInMemoryBlobStore() BlobStore {
+	return &inMemoryBlobStore{blobs: make(map[BlobRef][]byte)}
+}
+
+type inMemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[BlobRef][]byte
+}
+
+func (s *inMemoryBlobStore) Put(r io.Reader) (BlobRef, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	ref := BlobRef(hex.EncodeToString(sum[:]))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, has := s.blobs[ref]; !has {
+		s.blobs[ref] = content
+	}
+	return ref, nil
+}
+
+func (s *inMemoryBlobStore) Get(ref BlobRef) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	content, has := s.blobs[ref]
+	if !has {
+		return nil, errNoSuchBlob(ref)
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+type errNoSuchBlob BlobRef
+
+func (e errNoSuchBlob) Error() string {
+	return "no such blob: " + string(e)
+}
+
+// BlobChunk is a single chunk of a blob transfer, as sent/received over the TransferBlob streaming RPC.  A
+// transfer is a sequence of chunks for the same Ref, in increasing Offset order, with the final chunk signaled
+// by Offset+len(Data) == the blob's total size.
+type BlobChunk struct {
+	Ref    BlobRef
+	Offset int64
+	Data   []byte
+}
+
+// BlobChunkSender is the shape of the generated gRPC server-stream type for TransferBlob (e.g. the
+// pulumirpc.ResourceProvider_TransferBlobServer the provider .proto grows once streaming is in play): it lets a
+// handler push BlobChunks to the caller one at a time instead of returning the whole blob as a single message.
+type BlobChunkSender interface {
+	Send(*BlobChunk) error
+}
+
+// BlobChunkReceiver is the shape of the generated gRPC client-stream type for TransferBlob, letting a caller pull
+// BlobChunks one at a time.
+type BlobChunkReceiver interface {
+	Recv() (*BlobChunk, error)
+}
+
+// BlobTransferServer is the provider-side counterpart to the `TransferBlob(ref) returns (stream BlobChunk)` RPC
+// that the provider .proto grows once streaming is in play: a plugin pulls content it was only handed a BlobRef
+// for (instead of inline bytes) by opening a stream and reading chunks back.  It is expressed here in terms of
+// BlobChunkSender -- independent of the generated gRPC stream types -- so that BlobStore-backed plugins can be
+// exercised without depending on the .proto-derived stream plumbing.
+type BlobTransferServer interface {
+	// TransferBlob streams ref's content to stream as a sequence of fixed-size BlobChunks.
+	TransferBlob(ref BlobRef, stream BlobChunkSender) error
+}
+
+// NewBlobTransferServer adapts a BlobStore into a BlobTransferServer.
+func NewBlobTransferServer(blobs BlobStore) BlobTransferServer {
+	return &blobTransferServer{blobs: blobs}
+}
+
+type blobTransferServer struct {
+	blobs BlobStore
+}
+
+func (s *blobTransferServer) TransferBlob(ref BlobRef, stream BlobChunkSender) error {
+	rc, err := s.blobs.Get(ref)
+	if err != nil {
+		return err
+	}
+	defer contract.IgnoreClose(rc)
+
+	var offset int64
+	buf := make([]byte, transferChunkSize)
+	for {
+		n, readErr := rc.Read(buf)
+		if n > 0 {
+			chunk := &BlobChunk{Ref: ref, Offset: offset, Data: append([]byte(nil), buf[:n]...)}
+			if sendErr := stream.Send(chunk); sendErr != nil {
+				return sendErr
+			}
+			offset += int64(n)
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// blobChunkReader adapts a BlobChunkReceiver into an io.Reader, pulling one chunk at a time instead of requiring
+// the whole blob to be buffered up front.
+type blobChunkReader struct {
+	recv BlobChunkReceiver
+	buf  []byte
+}
+
+func (r *blobChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.recv.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// ReadBlobChunks adapts a BlobChunkReceiver (the client side of the streaming TransferBlob RPC) into an
+// io.ReadCloser, so a plugin can pull a blob's content on demand, one chunk at a time, instead of needing it
+// handed over as a single inline payload.
+func ReadBlobChunks(recv BlobChunkReceiver) io.ReadCloser {
+	return ioutil.NopCloser(&blobChunkReader{recv: recv})
+}
+
+// blobbable describes the minimal behavior MarshalAsset/MarshalArchive need from resource.Asset and
+// resource.Archive in order to consider streaming their contents through a BlobStore instead of inlining them.
+type blobbable interface {
+	Read() (io.ReadCloser, error)
+}
+
+// countingHashReader wraps a reader, accumulating a running sha256 and byte count of everything read through it
+// -- used so marshalBlob can learn a blob's hash and size from the same pass that streams it into the BlobStore,
+// rather than buffering the whole thing in memory first to compute them up front.
+type countingHashReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (c *countingHashReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.h.Write(p[:n])
+		c.n += int64(n)
+	}
+	return n, err
+}
+
+// peekChunkSize is how much of the content marshalBlob reads at a time while deciding whether it's worth
+// streaming.  Reading in small increments -- rather than allocating a full StreamThreshold-sized buffer up front
+// on every call -- keeps the common case (a small asset, well under the threshold) cheap.
+const peekChunkSize = 32 * 1024
+
+// blobRefKey marks a struct on the wire as a reference to content streamed through a BlobStore, as opposed to an
+// ordinary serialized asset/archive object; its sibling fields (blobKindKey, "sha256", "size") carry what's needed
+// to fetch and reconstitute it.
+const blobRefKey = "$blobref"
+
+// blobKindKey records which of the two blobbable property kinds a blobref struct was streamed from, so that
+// unmarshalBlob knows whether to reconstitute a resource.Asset or a resource.Archive.
+const blobKindKey = "$blobkind"
+
+// blobKindAsset and blobKindArchive are the blobKindKey values MarshalAsset and MarshalArchive tag their blobrefs
+// with, respectively.
+const (
+	blobKindAsset   = "asset"
+	blobKindArchive = "archive"
+)
+
+// isBlobRefStruct reports whether a struct on the wire is a blobref emitted by marshalBlob, rather than an
+// ordinary serialized asset/archive object or other nested object.
+func isBlobRefStruct(s *structpb.Struct) bool {
+	ref, has := s.Fields[blobRefKey]
+	return has && ref.GetStringValue() != ""
+}
+
+// marshalBlob streams v's content through opts.Blobs if it exceeds StreamThreshold, returning the resulting
+// `{"$blobref": ..., "$blobkind": ..., "sha256": ..., "size": ...}` reference value and true.  If the content is
+// small enough to inline, it returns (nil, false, nil) so the caller falls back to its normal serialize-and-inline
+// path.  Read and BlobStore failures are returned as an ordinary error rather than a contract.Failf panic: both are
+// ordinary runtime failures (a disk read error, a network blip talking to the blob store), not violated invariants.
+//
+// To decide which path applies without reading the whole (possibly huge) content into memory up front, we peek at
+// the content in small increments up to StreamThreshold bytes total: if that's all there is, the content is small
+// and we let the caller inline it as usual; otherwise we stream the peeked prefix plus the remainder straight into
+// the BlobStore, computing the hash and size incrementally as they pass through rather than buffering them first.
+func marshalBlob(v blobbable, kind string, opts MarshalOptions) (*structpb.Value, bool, error) {
+	rc, err := v.Read()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read asset/archive content for streaming: %v", err)
+	}
+	defer contract.IgnoreClose(rc)
+
+	var peek bytes.Buffer
+	chunk := make([]byte, peekChunkSize)
+	for peek.Len() <= StreamThreshold {
+		n, readErr := rc.Read(chunk)
+		if n > 0 {
+			peek.Write(chunk[:n])
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, false, fmt.Errorf("failed to read asset/archive content for streaming: %v", readErr)
+		}
+	}
+	if peek.Len() <= StreamThreshold {
+		return nil, false, nil // smaller than the threshold: let the caller inline it as usual.
+	}
+
+	counted := &countingHashReader{r: io.MultiReader(&peek, rc), h: sha256.New()}
+	ref, err := opts.Blobs.Put(counted)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to store blob in BlobStore: %v", err)
+	}
+	sum := counted.h.Sum(nil)
+	glog.V(7).Infof("Streaming %v-byte blob as %v (sha256=%x) instead of inlining", counted.n, ref, sum)
+
+	return &structpb.Value{
+		Kind: &structpb.Value_StructValue{
+			StructValue: &structpb.Struct{
+				Fields: map[string]*structpb.Value{
+					blobRefKey:  {Kind: &structpb.Value_StringValue{StringValue: string(ref)}},
+					blobKindKey: {Kind: &structpb.Value_StringValue{StringValue: kind}},
+					"sha256":    {Kind: &structpb.Value_StringValue{StringValue: hex.EncodeToString(sum)}},
+					"size":      {Kind: &structpb.Value_NumberValue{NumberValue: float64(counted.n)}},
+				},
+			},
+		},
+	}, true, nil
+}
+
+// unmarshalBlob is marshalBlob's inverse: it fetches a previously-streamed blob back out of opts.Blobs, verifies it
+// against the sha256 digest recorded at marshal time (so that a corrupted or truncated transfer is caught rather
+// than silently handed to the caller), and reconstitutes it as the resource.Asset or resource.Archive it was
+// streamed from.
+func unmarshalBlob(s *structpb.Struct, opts MarshalOptions) (resource.PropertyValue, error) {
+	if opts.Blobs == nil {
+		return resource.PropertyValue{}, fmt.Errorf("cannot unmarshal streamed blob: no BlobStore configured")
+	}
+	ref := BlobRef(s.Fields[blobRefKey].GetStringValue())
+	wantSum := s.Fields["sha256"].GetStringValue()
+	kind := s.Fields[blobKindKey].GetStringValue()
+
+	rc, err := opts.Blobs.Get(ref)
+	if err != nil {
+		return resource.PropertyValue{}, fmt.Errorf("failed to fetch streamed blob %v: %v", ref, err)
+	}
+	defer contract.IgnoreClose(rc)
+
+	var content bytes.Buffer
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(&content, h), rc); err != nil {
+		return resource.PropertyValue{}, fmt.Errorf("failed to read streamed blob %v: %v", ref, err)
+	}
+	if gotSum := hex.EncodeToString(h.Sum(nil)); gotSum != wantSum {
+		return resource.PropertyValue{}, fmt.Errorf(
+			"streamed blob %v failed integrity check: expected sha256=%v, got %v", ref, wantSum, gotSum)
+	}
+
+	switch kind {
+	case blobKindAsset:
+		return resource.NewAssetProperty(resource.NewByteAsset(content.Bytes())), nil
+	case blobKindArchive:
+		return resource.NewArchiveProperty(resource.NewByteArchive(content.Bytes())), nil
+	default:
+		return resource.PropertyValue{}, fmt.Errorf("streamed blob %v has unrecognized kind %q", ref, kind)
+	}
+}
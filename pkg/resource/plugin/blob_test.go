@@ -0,0 +1,90 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// testBlobbable is a minimal blobbable backed by an in-memory byte slice, for exercising marshalBlob/unmarshalBlob
+// without needing a real resource.Asset/Archive.
+type testBlobbable struct {
+	content []byte
+}
+
+func (b *testBlobbable) Read() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b.content)), nil
+}
+
+func TestMarshalBlobInlinesSmallContent(t *testing.T) {
+	opts := MarshalOptions{StreamLargeBlobs: true, Blobs: NewInMemoryBlobStore()}
+	small := &testBlobbable{content: []byte("hello world")}
+
+	v, streamed, err := marshalBlob(small, blobKindAsset, opts)
+	if err != nil {
+		t.Fatalf("marshalBlob failed: %v", err)
+	}
+	if streamed {
+		t.Fatalf("expected small content to be left for the caller to inline, got streamed=true, v=%v", v)
+	}
+}
+
+func TestMarshalUnmarshalBlobRoundTrip(t *testing.T) {
+	opts := MarshalOptions{StreamLargeBlobs: true, Blobs: NewInMemoryBlobStore()}
+	content := []byte(strings.Repeat("x", StreamThreshold+1))
+	big := &testBlobbable{content: content}
+
+	v, streamed, err := marshalBlob(big, blobKindArchive, opts)
+	if err != nil {
+		t.Fatalf("marshalBlob failed: %v", err)
+	}
+	if !streamed {
+		t.Fatalf("expected content over StreamThreshold to be streamed")
+	}
+
+	s := v.GetStructValue()
+	if !isBlobRefStruct(s) {
+		t.Fatalf("expected a blobref struct, got %v", s)
+	}
+
+	prop, err := unmarshalBlob(s, opts)
+	if err != nil {
+		t.Fatalf("unmarshalBlob failed: %v", err)
+	}
+	if !prop.IsArchive() {
+		t.Fatalf("expected an archive property, got %v", prop.V)
+	}
+}
+
+func TestUnmarshalBlobDetectsCorruption(t *testing.T) {
+	opts := MarshalOptions{StreamLargeBlobs: true, Blobs: NewInMemoryBlobStore()}
+	content := []byte(strings.Repeat("y", StreamThreshold+1))
+	big := &testBlobbable{content: content}
+
+	v, streamed, err := marshalBlob(big, blobKindAsset, opts)
+	if err != nil {
+		t.Fatalf("marshalBlob failed: %v", err)
+	}
+	if !streamed {
+		t.Fatalf("expected content over StreamThreshold to be streamed")
+	}
+
+	// Tamper with the recorded digest so it no longer matches the stored content.
+	s := v.GetStructValue()
+	wrongSum := sha256.Sum256([]byte("not the right content"))
+	s.Fields["sha256"] = &structpb.Value{
+		Kind: &structpb.Value_StringValue{StringValue: hex.EncodeToString(wrongSum[:])},
+	}
+
+	if _, err := unmarshalBlob(s, opts); err == nil {
+		t.Fatalf("expected unmarshalBlob to reject a tampered digest")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/pulumi/lumi/pkg/resource"
+	"github.com/pulumi/lumi/pkg/util/contract"
+)
+
+// Tags used to disambiguate property value kinds in the canonical hash encoding below; changing any of these
+// values changes every hash this package has ever produced, so treat them as part of the wire format.
+const (
+	hashTagNull byte = iota
+	hashTagBool
+	hashTagNumber
+	hashTagString
+	hashTagArray
+	hashTagObject
+	hashTagAsset
+	hashTagArchive
+	hashTagUnknown
+	hashTagSecret
+)
+
+// HashProperties produces a stable SHA-256 digest over a canonicalized encoding of props, suitable for cheaply
+// detecting no-op diffs or caching Check results.  Canonicalization sorts keys (via StableKeys), normalizes
+// numbers to their canonical IEEE-754 form (so 0 and -0 hash identically), encodes unknown/computed values as a
+// fixed sentinel byte regardless of their placeholder element, hashes assets/archives by their content rather
+// than their serialized form, and -- when opts.SkipNulls is set -- skips nulls exactly as MarshalProperties would.
+func HashProperties(props resource.PropertyMap, opts MarshalOptions) ([]byte, error) {
+	h := sha256.New()
+	if err := hashPropertyMap(h, props, opts); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func hashPropertyMap(h hash.Hash, props resource.PropertyMap, opts MarshalOptions) error {
+	for _, key := range props.StableKeys() {
+		v := props[key]
+		if v.IsOutput() {
+			continue // outputs are never part of the hashed identity of a property map.
+		} else if opts.SkipNulls && v.IsNull() {
+			continue
+		}
+		hashString(h, string(key))
+		if err := hashPropertyValue(h, v, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashPropertyValue(h hash.Hash, v resource.PropertyValue, opts MarshalOptions) error {
+	switch {
+	case v.IsNull():
+		h.Write([]byte{hashTagNull})
+	case v.IsBool():
+		h.Write([]byte{hashTagBool})
+		if v.BoolValue() {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	case v.IsNumber():
+		h.Write([]byte{hashTagNumber})
+		hashNumber(h, v.NumberValue())
+	case v.IsString():
+		h.Write([]byte{hashTagString})
+		hashString(h, v.StringValue())
+	case v.IsArray():
+		h.Write([]byte{hashTagArray})
+		for _, elem := range v.ArrayValue() {
+			if err := hashPropertyValue(h, elem, opts); err != nil {
+				return err
+			}
+		}
+	case v.IsAsset():
+		h.Write([]byte{hashTagAsset})
+		sum, err := contentHash(v.AssetValue())
+		if err != nil {
+			return err
+		}
+		h.Write(sum)
+	case v.IsArchive():
+		h.Write([]byte{hashTagArchive})
+		sum, err := contentHash(v.ArchiveValue())
+		if err != nil {
+			return err
+		}
+		h.Write(sum)
+	case v.IsObject():
+		h.Write([]byte{hashTagObject})
+		return hashPropertyMap(h, v.ObjectValue(), opts)
+	case v.IsSecret():
+		h.Write([]byte{hashTagSecret})
+		return hashPropertyValue(h, v.SecretValue().Element, opts)
+	case v.IsComputed():
+		h.Write([]byte{hashTagUnknown})
+	case v.IsOutput():
+		h.Write([]byte{hashTagUnknown})
+	default:
+		return fmt.Errorf("unrecognized property value: %v", v.V)
+	}
+	return nil
+}
+
+// hashString writes s to h with a length prefix, so that e.g. hashing "ab" then "c" can never collide with
+// hashing "a" then "bc".
+func hashString(h hash.Hash, s string) {
+	var lenbuf [8]byte
+	binary.BigEndian.PutUint64(lenbuf[:], uint64(len(s)))
+	h.Write(lenbuf[:])
+	io.WriteString(h, s)
+}
+
+// hashNumber writes n's canonical IEEE-754 bit pattern to h, first normalizing -0 to 0 so the two hash
+// identically (they compare equal and represent the same JSON number, but have distinct bit patterns).
+func hashNumber(h hash.Hash, n float64) {
+	if n == 0 {
+		n = 0
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(n))
+	h.Write(buf[:])
+}
+
+// contentHash returns the SHA-256 digest of v's underlying content, rather than its serialized representation,
+// so that e.g. an asset referenced by path and one referenced by URI hash identically whenever their bytes do.
+func contentHash(v blobbable) ([]byte, error) {
+	rc, err := v.Read()
+	if err != nil {
+		return nil, err
+	}
+	defer contract.IgnoreClose(rc)
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// DiffKind describes how a property at a given path changed between two property maps.
+type DiffKind int
+
+const (
+	// DiffAdd indicates a property that is present in the new map but not the old.
+	DiffAdd DiffKind = iota
+	// DiffDelete indicates a property that is present in the old map but not the new.
+	DiffDelete
+	// DiffUpdate indicates a property present in both maps whose canonicalized value differs.
+	DiffUpdate
+)
+
+// PropertyDiff describes a single changed property, as found by DiffProperties.
+type PropertyDiff struct {
+	Path string                  // the property key that changed (top-level only; see DiffProperties).
+	Old  resource.PropertyValue  // the old value; zero value if Kind is DiffAdd.
+	New  resource.PropertyValue  // the new value; zero value if Kind is DiffDelete.
+	Kind DiffKind
+}
+
+// DiffProperties returns the list of top-level properties that differ between old and new, using the same
+// canonicalization rules as HashProperties to decide equality -- so two assets that differ only in how they're
+// referenced, or two numbers that differ only in -0 vs 0, are correctly treated as unchanged.  This replaces the
+// ad-hoc reflection-based comparisons diffing has historically used.  Diffs are reported per top-level key, not
+// per nested path: a single changed field deep inside an object property is reported as that whole top-level
+// property having changed, which is sufficient for no-op detection and Check-result caching.
+func DiffProperties(olds, news resource.PropertyMap, opts MarshalOptions) ([]PropertyDiff, error) {
+	keys := make(map[resource.PropertyKey]bool)
+	for _, k := range olds.StableKeys() {
+		keys[k] = true
+	}
+	for _, k := range news.StableKeys() {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, string(k))
+	}
+	sort.Strings(sorted)
+
+	var diffs []PropertyDiff
+	for _, k := range sorted {
+		key := resource.PropertyKey(k)
+		ov, hasOld := olds[key]
+		nv, hasNew := news[key]
+		switch {
+		case !hasOld && hasNew:
+			diffs = append(diffs, PropertyDiff{Path: k, New: nv, Kind: DiffAdd})
+		case hasOld && !hasNew:
+			diffs = append(diffs, PropertyDiff{Path: k, Old: ov, Kind: DiffDelete})
+		default:
+			changed, err := valuesDiffer(ov, nv, opts)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				diffs = append(diffs, PropertyDiff{Path: k, Old: ov, New: nv, Kind: DiffUpdate})
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// valuesDiffer reports whether a and b canonicalize to different hashes.
+func valuesDiffer(a, b resource.PropertyValue, opts MarshalOptions) (bool, error) {
+	ha := sha256.New()
+	if err := hashPropertyValue(ha, a, opts); err != nil {
+		return false, err
+	}
+	hb := sha256.New()
+	if err := hashPropertyValue(hb, b, opts); err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(ha.Sum(nil), hb.Sum(nil)), nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/pulumi/lumi/pkg/resource"
+)
+
+func testProps(extra resource.PropertyMap) resource.PropertyMap {
+	props := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"name":  "widget",
+		"count": 42.0,
+		"tags":  []interface{}{"a", "b"},
+	})
+	for k, v := range extra {
+		props[k] = v
+	}
+	return props
+}
+
+func TestHashPropertiesDeterministic(t *testing.T) {
+	opts := MarshalOptions{}
+	a, err := HashProperties(testProps(nil), opts)
+	if err != nil {
+		t.Fatalf("HashProperties failed: %v", err)
+	}
+	b, err := HashProperties(testProps(nil), opts)
+	if err != nil {
+		t.Fatalf("HashProperties failed: %v", err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatalf("expected identical property maps to hash identically")
+	}
+}
+
+func TestHashPropertiesNormalizesNegativeZero(t *testing.T) {
+	opts := MarshalOptions{}
+	zero := testProps(resource.PropertyMap{"n": resource.NewNumberProperty(0)})
+	negZero := testProps(resource.PropertyMap{"n": resource.NewNumberProperty(math.Copysign(0, -1))})
+
+	hz, err := HashProperties(zero, opts)
+	if err != nil {
+		t.Fatalf("HashProperties failed: %v", err)
+	}
+	hnz, err := HashProperties(negZero, opts)
+	if err != nil {
+		t.Fatalf("HashProperties failed: %v", err)
+	}
+	if !bytes.Equal(hz, hnz) {
+		t.Fatalf("expected 0 and -0 to hash identically")
+	}
+}
+
+func TestHashPropertiesDetectsChange(t *testing.T) {
+	opts := MarshalOptions{}
+	a, err := HashProperties(testProps(nil), opts)
+	if err != nil {
+		t.Fatalf("HashProperties failed: %v", err)
+	}
+	changed := testProps(resource.PropertyMap{"name": resource.NewStringProperty("other-widget")})
+	b, err := HashProperties(changed, opts)
+	if err != nil {
+		t.Fatalf("HashProperties failed: %v", err)
+	}
+	if bytes.Equal(a, b) {
+		t.Fatalf("expected changed property maps to hash differently")
+	}
+}
+
+func TestDiffPropertiesAddUpdateDelete(t *testing.T) {
+	opts := MarshalOptions{}
+	olds := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"keep":   "same",
+		"change": "old",
+		"remove": "gone",
+	})
+	news := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"keep":   "same",
+		"change": "new",
+		"add":    "fresh",
+	})
+
+	diffs, err := DiffProperties(olds, news, opts)
+	if err != nil {
+		t.Fatalf("DiffProperties failed: %v", err)
+	}
+
+	byPath := make(map[string]PropertyDiff)
+	for _, d := range diffs {
+		byPath[d.Path] = d
+	}
+
+	if _, has := byPath["keep"]; has {
+		t.Fatalf("did not expect an unchanged property to be reported as a diff")
+	}
+	if d, has := byPath["change"]; !has || d.Kind != DiffUpdate {
+		t.Fatalf("expected \"change\" to be reported as a DiffUpdate, got %+v", d)
+	}
+	if d, has := byPath["add"]; !has || d.Kind != DiffAdd {
+		t.Fatalf("expected \"add\" to be reported as a DiffAdd, got %+v", d)
+	}
+	if d, has := byPath["remove"]; !has || d.Kind != DiffDelete {
+		t.Fatalf("expected \"remove\" to be reported as a DiffDelete, got %+v", d)
+	}
+}
@@ -15,17 +15,23 @@ import (
 
 // MarshalOptions controls the marshaling of RPC structures.
 type MarshalOptions struct {
-	SkipNulls    bool // true to skip nulls altogether in the resulting map.
-	OldURNs      bool // true to permit old URNs in the properties (e.g., for pre-update).
-	RawResources bool // true to marshal resources "as-is"; often used when ID mappings aren't known yet.
+	SkipNulls        bool      // true to skip nulls altogether in the resulting map.
+	OldURNs          bool      // true to permit old URNs in the properties (e.g., for pre-update).
+	RawResources     bool      // true to marshal resources "as-is"; often used when ID mappings aren't known yet.
+	StreamLargeBlobs bool      // true to stream asset/archive content through Blobs rather than inlining it.
+	Blobs            BlobStore // the store to use for large asset/archive content when StreamLargeBlobs is set.
+	KeepSecrets      bool      // true to retain the secret wrapper when marshaling; false unwraps to plaintext.
+	Cipher           Cipher    // the cipher to use to encrypt/decrypt secret values when KeepSecrets is set.
 }
 
 // MarshalPropertiesWithUnknowns marshals a resource's property map as a "JSON-like" protobuf structure.  Any URNs are
 // replaced with their resource IDs during marshaling; it is an error to marshal a URN for a resource without an ID.  A
 // map of any unknown properties encountered during marshaling (latent values) is returned on the side; these values are
 // marshaled using the default value in the returned structure and so this map is essential for interpreting results.
+// It returns an error, rather than panicking, if any property value failed to marshal -- e.g. a large asset that
+// couldn't be streamed to its BlobStore -- since that failure originates from ordinary I/O, not a violated invariant.
 func MarshalPropertiesWithUnknowns(
-	props resource.PropertyMap, opts MarshalOptions) (*structpb.Struct, map[string]bool) {
+	props resource.PropertyMap, opts MarshalOptions) (*structpb.Struct, map[string]bool, error) {
 	var unk map[string]bool
 	result := &structpb.Struct{
 		Fields: make(map[string]*structpb.Value),
@@ -41,7 +47,10 @@ func MarshalPropertiesWithUnknowns(
 			continue // skip nulls if requested.
 		}
 
-		mv, known := MarshalPropertyValue(v, opts)
+		mv, known, err := MarshalPropertyValue(v, opts)
+		if err != nil {
+			return nil, nil, err
+		}
 		result.Fields[string(key)] = mv
 
 		// If the property was unknown, note it, so that we may tell the provider.
@@ -52,41 +61,49 @@ func MarshalPropertiesWithUnknowns(
 			unk[string(key)] = true
 		}
 	}
-	return result, unk
+	return result, unk, nil
 }
 
 // MarshalProperties performs ordinary marshaling of a resource's properties but then validates afterwards that all
 // fields were known (in other words, no latent properties were encountered).
-func MarshalProperties(props resource.PropertyMap, opts MarshalOptions) *structpb.Struct {
-	pstr, unks := MarshalPropertiesWithUnknowns(props, opts)
+func MarshalProperties(props resource.PropertyMap, opts MarshalOptions) (*structpb.Struct, error) {
+	pstr, unks, err := MarshalPropertiesWithUnknowns(props, opts)
+	if err != nil {
+		return nil, err
+	}
 	contract.Assertf(unks == nil, "Unexpected unknown properties during final marshaling")
-	return pstr
+	return pstr, nil
 }
 
 // MarshalPropertyValue marshals a single resource property value into its "JSON-like" value representation.  The
-// boolean return value indicates whether the value was known (true) or unknown (false).
-func MarshalPropertyValue(v resource.PropertyValue, opts MarshalOptions) (*structpb.Value, bool) {
+// boolean return value indicates whether the value was known (true) or unknown (false).  It returns an error, rather
+// than panicking, if marshaling failed due to an ordinary runtime failure (e.g. a disk read error streaming a large
+// asset) as opposed to a violated invariant in this process's own code.
+func MarshalPropertyValue(v resource.PropertyValue, opts MarshalOptions) (*structpb.Value, bool, error) {
 	if v.IsNull() {
-		return MarshalNull(opts), true
+		return MarshalNull(opts), true, nil
 	} else if v.IsBool() {
 		return &structpb.Value{
 			Kind: &structpb.Value_BoolValue{
 				BoolValue: v.BoolValue(),
 			},
-		}, true
+		}, true, nil
 	} else if v.IsNumber() {
 		return &structpb.Value{
 			Kind: &structpb.Value_NumberValue{
 				NumberValue: v.NumberValue(),
 			},
-		}, true
+		}, true, nil
 	} else if v.IsString() {
-		return MarshalString(v.StringValue(), opts), true
+		return MarshalString(v.StringValue(), opts), true, nil
 	} else if v.IsArray() {
 		outcome := true
 		var elems []*structpb.Value
 		for _, elem := range v.ArrayValue() {
-			elemv, known := MarshalPropertyValue(elem, opts)
+			elemv, known, err := MarshalPropertyValue(elem, opts)
+			if err != nil {
+				return nil, false, err
+			}
 			outcome = outcome && known
 			elems = append(elems, elemv)
 		}
@@ -94,34 +111,47 @@ func MarshalPropertyValue(v resource.PropertyValue, opts MarshalOptions) (*struc
 			Kind: &structpb.Value_ListValue{
 				ListValue: &structpb.ListValue{Values: elems},
 			},
-		}, outcome
+		}, outcome, nil
 	} else if v.IsAsset() {
 		return MarshalAsset(v.AssetValue(), opts)
 	} else if v.IsArchive() {
 		return MarshalArchive(v.ArchiveValue(), opts)
+	} else if v.IsSecret() {
+		return MarshalSecret(v.SecretValue(), opts)
 	} else if v.IsObject() {
-		obj, unks := MarshalPropertiesWithUnknowns(v.ObjectValue(), opts)
-		return MarshalStruct(obj, opts), unks == nil
+		obj, unks, err := MarshalPropertiesWithUnknowns(v.ObjectValue(), opts)
+		if err != nil {
+			return nil, false, err
+		}
+		return MarshalStruct(obj, opts), unks == nil, nil
 	} else if v.IsComputed() {
 		e := v.ComputedValue().Element
 		contract.Assert(!e.IsComputed())
-		w, known := MarshalPropertyValue(e, opts)
+		w, known, err := MarshalPropertyValue(e, opts)
+		if err != nil {
+			return nil, false, err
+		}
 		contract.Assert(known)
-		return w, false
+		return w, false, nil
 	} else if v.IsOutput() {
 		e := v.OutputValue().Element
 		contract.Assert(!e.IsComputed())
-		w, known := MarshalPropertyValue(e, opts)
+		w, known, err := MarshalPropertyValue(e, opts)
+		if err != nil {
+			return nil, false, err
+		}
 		contract.Assert(known)
-		return w, false
+		return w, false, nil
 	}
 
 	contract.Failf("Unrecognized property value: %v (type=%v)", v.V, reflect.TypeOf(v.V))
-	return nil, true
+	return nil, true, nil
 }
 
-// UnmarshalProperties unmarshals a "JSON-like" protobuf structure into a new resource property map.
-func UnmarshalProperties(props *structpb.Struct, opts MarshalOptions) resource.PropertyMap {
+// UnmarshalProperties unmarshals a "JSON-like" protobuf structure into a new resource property map.  It returns an
+// error if any property value failed to unmarshal -- e.g. a secret whose ciphertext couldn't be decrypted -- rather
+// than panicking, since the input crossed a process boundary and may simply be bad.
+func UnmarshalProperties(props *structpb.Struct, opts MarshalOptions) (resource.PropertyMap, error) {
 	result := make(resource.PropertyMap)
 
 	// First sort the keys so we enumerate them in order (in case errors happen, we want determinism).
@@ -136,7 +166,10 @@ func UnmarshalProperties(props *structpb.Struct, opts MarshalOptions) resource.P
 	// And now unmarshal every field it into the map.
 	for _, key := range keys {
 		pk := resource.PropertyKey(key)
-		v := UnmarshalPropertyValue(props.Fields[key], opts)
+		v, err := UnmarshalPropertyValue(props.Fields[key], opts)
+		if err != nil {
+			return nil, err
+		}
 		glog.V(9).Infof("Unmarshaling property for RPC: %v=%v", key, v)
 		contract.Assert(!v.IsComputed())
 		if opts.SkipNulls && v.IsNull() {
@@ -146,51 +179,83 @@ func UnmarshalProperties(props *structpb.Struct, opts MarshalOptions) resource.P
 		}
 	}
 
-	return result
+	return result, nil
 }
 
-// UnmarshalPropertyValue unmarshals a single "JSON-like" value into a new property value.
-func UnmarshalPropertyValue(v *structpb.Value, opts MarshalOptions) resource.PropertyValue {
+// UnmarshalPropertyValue unmarshals a single "JSON-like" value into a new property value.  It returns an error,
+// rather than panicking, for failures that originate from the wire content itself (currently: undecryptable
+// secrets) as opposed to a violated invariant in this process's own code.
+func UnmarshalPropertyValue(v *structpb.Value, opts MarshalOptions) (resource.PropertyValue, error) {
 	contract.Assert(v != nil)
 
 	switch v.Kind.(type) {
 	case *structpb.Value_NullValue:
-		return resource.NewNullProperty()
+		return resource.NewNullProperty(), nil
 	case *structpb.Value_BoolValue:
-		return resource.NewBoolProperty(v.GetBoolValue())
+		return resource.NewBoolProperty(v.GetBoolValue()), nil
 	case *structpb.Value_NumberValue:
-		return resource.NewNumberProperty(v.GetNumberValue())
+		return resource.NewNumberProperty(v.GetNumberValue()), nil
 	case *structpb.Value_StringValue:
-		return resource.NewStringProperty(v.GetStringValue())
+		return resource.NewStringProperty(v.GetStringValue()), nil
 	case *structpb.Value_ListValue:
 		// If there's already an array, prefer to swap elements within it.
 		var elems []resource.PropertyValue
+		secret := false
 		lst := v.GetListValue()
 		for i, elem := range lst.GetValues() {
 			if i == len(elems) {
 				elems = append(elems, resource.PropertyValue{})
 			}
 			contract.Assert(len(elems) > i)
-			elems[i] = UnmarshalPropertyValue(elem, opts)
+			ev, err := UnmarshalPropertyValue(elem, opts)
+			if err != nil {
+				return resource.PropertyValue{}, err
+			}
+			elems[i] = ev
+			secret = secret || elems[i].IsSecret()
 		}
 
-		return resource.NewArrayProperty(elems)
+		arr := resource.NewArrayProperty(elems)
+		if secret {
+			// Propagate secretness: an array containing a secret element is itself secret.
+			return resource.MakeSecret(arr), nil
+		}
+		return arr, nil
 	case *structpb.Value_StructValue:
+		s := v.GetStructValue()
+		if isSecretStruct(s) {
+			return UnmarshalSecret(s, opts)
+		}
+		if isBlobRefStruct(s) {
+			return unmarshalBlob(s, opts)
+		}
+
 		// Start by unmarshaling.
-		obj := UnmarshalProperties(v.GetStructValue(), opts)
+		obj, err := UnmarshalProperties(s, opts)
+		if err != nil {
+			return resource.PropertyValue{}, err
+		}
 
 		// Before returning it as an object, check to see if it's a known recoverable type.
 		objmap := obj.Mappable()
 		if asset, isasset := resource.DeserializeAsset(objmap); isasset {
-			return resource.NewAssetProperty(asset)
+			return resource.NewAssetProperty(asset), nil
 		} else if archive, isarchive := resource.DeserializeArchive(objmap); isarchive {
-			return resource.NewArchiveProperty(archive)
+			return resource.NewArchiveProperty(archive), nil
+		}
+
+		result := resource.NewObjectProperty(obj)
+		for _, pv := range obj {
+			if pv.IsSecret() {
+				// Propagate secretness: an object containing a secret property is itself secret.
+				return resource.MakeSecret(result), nil
+			}
 		}
-		return resource.NewObjectProperty(obj)
+		return result, nil
 
 	default:
 		contract.Failf("Unrecognized structpb value kind: %v", reflect.TypeOf(v.Kind))
-		return resource.NewNullProperty()
+		return resource.NewNullProperty(), nil
 	}
 }
 
@@ -221,16 +286,44 @@ func MarshalStruct(obj *structpb.Struct, opts MarshalOptions) *structpb.Value {
 	}
 }
 
-// MarshalAsset marshals an asset into its wire form for resource provider plugins.
-func MarshalAsset(v resource.Asset, opts MarshalOptions) (*structpb.Value, bool) {
+// MarshalAsset marshals an asset into its wire form for resource provider plugins.  If opts.StreamLargeBlobs is
+// set and the asset's content is large enough to risk tripping gRPC's message size limit, its bytes are stored in
+// opts.Blobs and a `{"$blobref": ...}` reference is emitted instead; see marshalBlob for the threshold.  It returns
+// an error, rather than panicking, if streaming the content failed -- that's an ordinary I/O failure, not a
+// violated invariant.
+func MarshalAsset(v resource.Asset, opts MarshalOptions) (*structpb.Value, bool, error) {
+	if opts.StreamLargeBlobs && opts.Blobs != nil {
+		blob, streamed, err := marshalBlob(v, blobKindAsset, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		if streamed {
+			return blob, true, nil
+		}
+	}
+
 	// To marshal an asset, we need to first serialize it, and then marshal that.
 	sera := v.Serialize()
 	serap := resource.NewPropertyMapFromMap(sera)
 	return MarshalPropertyValue(resource.NewObjectProperty(serap), opts)
 }
 
-// MarshalArchive marshals an archive into its wire form for resource provider plugins.
-func MarshalArchive(v resource.Archive, opts MarshalOptions) (*structpb.Value, bool) {
+// MarshalArchive marshals an archive into its wire form for resource provider plugins.  If opts.StreamLargeBlobs
+// is set and the archive's content is large enough to risk tripping gRPC's message size limit, its bytes are
+// stored in opts.Blobs and a `{"$blobref": ...}` reference is emitted instead; see marshalBlob for the threshold.
+// It returns an error, rather than panicking, if streaming the content failed -- that's an ordinary I/O failure,
+// not a violated invariant.
+func MarshalArchive(v resource.Archive, opts MarshalOptions) (*structpb.Value, bool, error) {
+	if opts.StreamLargeBlobs && opts.Blobs != nil {
+		blob, streamed, err := marshalBlob(v, blobKindArchive, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		if streamed {
+			return blob, true, nil
+		}
+	}
+
 	// To marshal an archive, we need to first serialize it, and then marshal that.
 	sera := v.Serialize()
 	serap := resource.NewPropertyMapFromMap(sera)
@@ -0,0 +1,195 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	"github.com/pulumi/lumi/pkg/resource"
+	"github.com/pulumi/lumi/pkg/util/contract"
+)
+
+// secretSentinelKey marks a struct on the wire as a wrapped secret value, as opposed to an ordinary object
+// property; its sibling "ciphertext" field carries the encrypted inner value.
+const secretSentinelKey = "@@secret@@"
+
+// Cipher encrypts and decrypts secret property values for the wire.  The default implementation is AES-GCM
+// (see NewAESGCMCipher); NewKMSCipher and NewVaultCipher adapt an external key-management service to the same
+// interface so a deployment can keep the encryption key out of the engine's process entirely.
+type Cipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// NewAESGCMCipher returns a Cipher that encrypts with AES-256-GCM using the given 32-byte key.  It is the
+// default Cipher used when a deployment has no external key-management service configured.
+func NewAESGCMCipher(key [32]byte) Cipher {
+	return &aesGCMCipher{key: key}
+}
+
+type aesGCMCipher struct {
+	key [32]byte
+}
+
+func (c *aesGCMCipher) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *aesGCMCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	// Prepend the nonce so Decrypt doesn't need it passed out-of-band.
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *aesGCMCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+	size := gcm.NonceSize()
+	if len(ciphertext) < size {
+		return nil, fmt.Errorf("ciphertext too short to contain a nonce")
+	}
+	nonce, sealed := ciphertext[:size], ciphertext[size:]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// KMSClient is the minimal surface NewKMSCipher needs from a key-management service client -- intentionally
+// small so that adapting e.g. the AWS KMS or Google Cloud KMS SDKs is a few lines, without this package taking a
+// direct dependency on either.
+type KMSClient interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// NewKMSCipher adapts a KMSClient bound to a particular key ID into a Cipher.
+func NewKMSCipher(keyID string, client KMSClient) Cipher {
+	return &kmsCipher{keyID: keyID, client: client}
+}
+
+type kmsCipher struct {
+	keyID  string
+	client KMSClient
+}
+
+func (c *kmsCipher) Encrypt(plaintext []byte) ([]byte, error) { return c.client.Encrypt(c.keyID, plaintext) }
+func (c *kmsCipher) Decrypt(ciphertext []byte) ([]byte, error) { return c.client.Decrypt(c.keyID, ciphertext) }
+
+// VaultClient is the minimal surface NewVaultCipher needs from a HashiCorp Vault transit-engine client.
+type VaultClient interface {
+	Encrypt(transitPath string, plaintext []byte) ([]byte, error)
+	Decrypt(transitPath string, ciphertext []byte) ([]byte, error)
+}
+
+// NewVaultCipher adapts a VaultClient bound to a particular transit key path into a Cipher.
+func NewVaultCipher(transitPath string, client VaultClient) Cipher {
+	return &vaultCipher{transitPath: transitPath, client: client}
+}
+
+type vaultCipher struct {
+	transitPath string
+	client      VaultClient
+}
+
+func (c *vaultCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.client.Encrypt(c.transitPath, plaintext)
+}
+func (c *vaultCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	return c.client.Decrypt(c.transitPath, ciphertext)
+}
+
+// MarshalSecret marshals a secret property's inner element and, when opts.KeepSecrets is set, wraps the result
+// in the `{"@@secret@@": true, "ciphertext": "..."}` tagged struct using opts.Cipher.  When KeepSecrets is false,
+// the wrapper is dropped and the plaintext inner value is returned instead, for providers that don't understand
+// secrets; it is then the caller's responsibility to ensure the resulting checkpoint/state re-wraps the value
+// as secret rather than persisting it in the clear.
+func MarshalSecret(s *resource.Secret, opts MarshalOptions) (*structpb.Value, bool, error) {
+	inner, known, err := MarshalPropertyValue(s.Element, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if !opts.KeepSecrets {
+		return inner, known, nil
+	}
+
+	contract.Assert(opts.Cipher != nil)
+	var marshaler jsonpb.Marshaler
+	plaintext, err := marshaler.MarshalToString(inner)
+	if err != nil {
+		contract.Failf("failed to marshal secret element to JSON: %v", err)
+	}
+
+	ciphertext, err := opts.Cipher.Encrypt([]byte(plaintext))
+	if err != nil {
+		contract.Failf("failed to encrypt secret value: %v", err)
+	}
+
+	// Ciphertext is arbitrary binary, but this struct ends up serialized as JSON (by jsonpb, or by the jsonrpc
+	// gateway) wherever a structpb.Value travels, and JSON/protobuf string fields must be valid UTF-8.  Base64
+	// encode it so it survives that trip intact.
+	return &structpb.Value{
+		Kind: &structpb.Value_StructValue{
+			StructValue: &structpb.Struct{
+				Fields: map[string]*structpb.Value{
+					secretSentinelKey: {Kind: &structpb.Value_BoolValue{BoolValue: true}},
+					"ciphertext":      MarshalString(base64.StdEncoding.EncodeToString(ciphertext), opts),
+				},
+			},
+		},
+	}, known, nil
+}
+
+// isSecretStruct reports whether a struct on the wire is a tagged secret wrapper rather than an ordinary object.
+func isSecretStruct(s *structpb.Struct) bool {
+	tag, has := s.Fields[secretSentinelKey]
+	return has && tag.GetBoolValue()
+}
+
+// UnmarshalSecret decrypts and unmarshals a tagged secret wrapper back into a secret property value.  Unlike most
+// of this package's marshal/unmarshal helpers, failures here are reported as an ordinary error rather than a
+// contract.Failf panic: the ciphertext crossed a process/trust boundary (another plugin, a persisted checkpoint, a
+// rotated or simply wrong key), so a bad or truncated value is expected, recoverable input, not a programming
+// invariant violation.
+func UnmarshalSecret(s *structpb.Struct, opts MarshalOptions) (resource.PropertyValue, error) {
+	contract.Assert(opts.Cipher != nil)
+
+	ciphertext, err := base64.StdEncoding.DecodeString(s.Fields["ciphertext"].GetStringValue())
+	if err != nil {
+		return resource.PropertyValue{}, fmt.Errorf("failed to decode secret ciphertext: %v", err)
+	}
+
+	plaintext, err := opts.Cipher.Decrypt(ciphertext)
+	if err != nil {
+		return resource.PropertyValue{}, fmt.Errorf("failed to decrypt secret value: %v", err)
+	}
+
+	var inner structpb.Value
+	if err := jsonpb.UnmarshalString(string(plaintext), &inner); err != nil {
+		return resource.PropertyValue{}, fmt.Errorf("failed to unmarshal decrypted secret value: %v", err)
+	}
+
+	elem, err := UnmarshalPropertyValue(&inner, opts)
+	if err != nil {
+		return resource.PropertyValue{}, err
+	}
+	return resource.MakeSecret(elem), nil
+}
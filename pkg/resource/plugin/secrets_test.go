@@ -0,0 +1,74 @@
+// Copyright 2016-2017, Pulumi Corporation.  All rights reserved.
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/pulumi/lumi/pkg/resource"
+)
+
+func testCipher() Cipher {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	return NewAESGCMCipher(key)
+}
+
+func TestMarshalUnmarshalSecretRoundTrip(t *testing.T) {
+	opts := MarshalOptions{KeepSecrets: true, Cipher: testCipher()}
+	secret := resource.MakeSecret(resource.NewStringProperty("hunter2")).SecretValue()
+
+	v, known, err := MarshalSecret(secret, opts)
+	if err != nil {
+		t.Fatalf("MarshalSecret failed: %v", err)
+	}
+	if !known {
+		t.Fatalf("expected a plain string secret to be known")
+	}
+
+	got, err := UnmarshalSecret(v.GetStructValue(), opts)
+	if err != nil {
+		t.Fatalf("UnmarshalSecret failed: %v", err)
+	}
+	if !got.IsSecret() {
+		t.Fatalf("expected unmarshaled value to remain a secret")
+	}
+	if got.SecretValue().Element.StringValue() != "hunter2" {
+		t.Fatalf("secret round trip produced wrong plaintext: %v", got.SecretValue().Element)
+	}
+}
+
+func TestUnmarshalSecretBadCiphertextReturnsError(t *testing.T) {
+	opts := MarshalOptions{KeepSecrets: true, Cipher: testCipher()}
+	secret := resource.MakeSecret(resource.NewStringProperty("hunter2")).SecretValue()
+
+	v, _, err := MarshalSecret(secret, opts)
+	if err != nil {
+		t.Fatalf("MarshalSecret failed: %v", err)
+	}
+
+	s := v.GetStructValue()
+	s.Fields["ciphertext"] = MarshalString("not valid base64!!", opts)
+
+	if _, err := UnmarshalSecret(s, opts); err == nil {
+		t.Fatalf("expected UnmarshalSecret to return an error for malformed ciphertext, not panic")
+	}
+}
+
+func TestUnmarshalSecretWrongKeyReturnsError(t *testing.T) {
+	opts := MarshalOptions{KeepSecrets: true, Cipher: testCipher()}
+	secret := resource.MakeSecret(resource.NewStringProperty("hunter2")).SecretValue()
+
+	v, _, err := MarshalSecret(secret, opts)
+	if err != nil {
+		t.Fatalf("MarshalSecret failed: %v", err)
+	}
+
+	var wrongKey [32]byte
+	copy(wrongKey[:], "fedcba9876543210fedcba9876543210")
+	wrongOpts := MarshalOptions{KeepSecrets: true, Cipher: NewAESGCMCipher(wrongKey)}
+
+	if _, err := UnmarshalSecret(v.GetStructValue(), wrongOpts); err == nil {
+		t.Fatalf("expected UnmarshalSecret to return an error when decrypting with the wrong key, not panic")
+	}
+}